@@ -1,20 +1,16 @@
 package token
 
 import (
-	"crypto"
-	"crypto/x509"
-	"encoding/pem"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"os"
+	"net/url"
 	"strings"
+	"time"
 
-	"github.com/docker/libtrust"
+	"golang.org/x/net/context"
 
 	"github.com/docker/distribution/auth"
-	"github.com/docker/distribution/collections"
 )
 
 // accessSet maps a typed, named resource to
@@ -80,6 +76,13 @@ type authChallenge struct {
 	realm     string
 	service   string
 	accessSet accessSet
+	schemes   []SchemeHandler
+
+	// autoRedirect and autoRedirectPath, when set, cause this challenge to
+	// respond with a redirect to the token issuer on the request's own host
+	// instead of a WWW-Authenticate header.
+	autoRedirect     bool
+	autoRedirectPath string
 }
 
 // Error returns the internal error string for this authChallenge.
@@ -89,56 +92,96 @@ func (ac *authChallenge) Error() string {
 
 // Status returns the HTTP Response Status Code for this authChallenge.
 func (ac *authChallenge) Status() int {
+	if ac.autoRedirect {
+		return http.StatusFound
+	}
+
 	return http.StatusUnauthorized
 }
 
-// challengeParams constructs the value to be used in
-// the WWW-Authenticate response challenge header.
-// See https://tools.ietf.org/html/rfc6750#section-3
-func (ac *authChallenge) challengeParams() string {
-	str := fmt.Sprintf("Bearer realm=%q,service=%q", ac.realm, ac.service)
-
-	if scope := ac.accessSet.scopeParam(); scope != "" {
-		str = fmt.Sprintf("%s,scope=%q", str, scope)
-	}
+// challengeParams constructs the values to be used in the WWW-Authenticate
+// response challenge headers: one per registered scheme handler, so clients
+// can negotiate which authentication mechanism to use.
+// See https://tools.ietf.org/html/rfc7235#section-2.1
+func (ac *authChallenge) challengeParams() []string {
+	params := make([]string, 0, len(ac.schemes))
+
+	for _, scheme := range ac.schemes {
+		str := fmt.Sprintf("%s %s", scheme.Scheme(), scheme.Challenge(ac.accessSet))
+
+		if scheme.Scheme() == "Bearer" {
+			if ac.err == ErrInvalidToken || ac.err == ErrMalformedToken {
+				str = fmt.Sprintf("%s,error=%q", str, "invalid_token")
+			} else if ac.err == ErrInsufficientScope {
+				str = fmt.Sprintf("%s,error=%q", str, "insufficient_scope")
+			}
+		}
 
-	if ac.err == ErrInvalidToken || ac.err == ErrMalformedToken {
-		str = fmt.Sprintf("%s,error=%q", str, "invalid_token")
-	} else if ac.err == ErrInsufficientScope {
-		str = fmt.Sprintf("%s,error=%q", str, "insufficient_scope")
+		params = append(params, str)
 	}
 
-	return str
+	return params
 }
 
-// SetHeader sets the WWW-Authenticate value for the given header.
-func (ac *authChallenge) SetHeader(header http.Header) {
-	header.Add("WWW-Authenticate", ac.challengeParams())
+// SetHeader sets the challenge header for the given request and response.
+// When autoRedirect is enabled, it sets a Location header pointing at the
+// token issuer on the requesting host instead of a WWW-Authenticate header,
+// so operators don't have to hardcode the token realm in config.
+func (ac *authChallenge) SetHeader(r *http.Request, header http.Header) {
+	if ac.autoRedirect {
+		redirectURL := url.URL{
+			Scheme: "https",
+			Host:   r.Host,
+			Path:   ac.autoRedirectPath,
+			RawQuery: url.Values{
+				"service":   {ac.service},
+				"scope":     {ac.accessSet.scopeParam()},
+				"client_id": {ac.service},
+			}.Encode(),
+		}
+		header.Set("Location", redirectURL.String())
+		return
+	}
+
+	for _, param := range ac.challengeParams() {
+		header.Add("WWW-Authenticate", param)
+	}
 }
 
 // ServeHttp handles writing the challenge response
 // by setting the challenge header and status code.
 func (ac *authChallenge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ac.SetHeader(w.Header())
+	ac.SetHeader(r, w.Header())
 	w.WriteHeader(ac.Status())
 }
 
 // accessController implements the auth.AccessController interface.
 type accessController struct {
-	realm       string
-	issuer      string
-	service     string
-	rootCerts   *x509.CertPool
-	trustedKeys map[string]libtrust.PublicKey
+	realm            string
+	issuer           string
+	service          string
+	schemes          []SchemeHandler
+	autoRedirect     bool
+	autoRedirectPath string
 }
 
 // tokenAccessOptions is a convenience type for handling
 // options to the contstructor of an accessController.
 type tokenAccessOptions struct {
-	realm          string
-	issuer         string
-	service        string
-	rootCertBundle string
+	realm            string
+	issuer           string
+	service          string
+	rootCertBundle   string
+	autoRedirect     bool
+	autoRedirectPath string
+
+	// jwks, jwksRefreshInterval, and jwksCACertBundle configure a
+	// TrustedKeyProvider that polls a remote JWKS endpoint instead of
+	// loading a static rootCertBundle. Exactly one of rootCertBundle or
+	// jwks must be set.
+	jwks                string
+	jwksRefreshInterval time.Duration
+	jwksCACertBundle    string
 }
 
 // checkOptions gathers the necessary options
@@ -146,7 +189,7 @@ type tokenAccessOptions struct {
 func checkOptions(options map[string]interface{}) (tokenAccessOptions, error) {
 	var opts tokenAccessOptions
 
-	keys := []string{"realm", "issuer", "service", "rootCertBundle"}
+	keys := []string{"realm", "issuer", "service"}
 	vals := make([]string, 0, len(keys))
 	for _, key := range keys {
 		val, ok := options[key].(string)
@@ -156,7 +199,37 @@ func checkOptions(options map[string]interface{}) (tokenAccessOptions, error) {
 		vals = append(vals, val)
 	}
 
-	opts.realm, opts.issuer, opts.service, opts.rootCertBundle = vals[0], vals[1], vals[2], vals[3]
+	opts.realm, opts.issuer, opts.service = vals[0], vals[1], vals[2]
+
+	rootCertBundle, hasRootCertBundle := options["rootCertBundle"].(string)
+	jwks, hasJWKS := options["jwks"].(string)
+
+	if hasRootCertBundle == hasJWKS {
+		return opts, fmt.Errorf("token auth requires exactly one of %q or %q", "rootCertBundle", "jwks")
+	}
+
+	opts.rootCertBundle, opts.jwks = rootCertBundle, jwks
+
+	if refreshInterval, ok := options["jwksRefreshInterval"].(string); ok {
+		d, err := time.ParseDuration(refreshInterval)
+		if err != nil {
+			return opts, fmt.Errorf("invalid jwksRefreshInterval %q: %s", refreshInterval, err)
+		}
+		opts.jwksRefreshInterval = d
+	}
+	if jwksCACertBundle, ok := options["jwksCACertBundle"].(string); ok {
+		opts.jwksCACertBundle = jwksCACertBundle
+	}
+
+	// autoredirect and autoredirectpath are optional; when enabled, the
+	// Authorized challenge redirects to the token issuer on the request's
+	// own host instead of advertising a WWW-Authenticate realm.
+	if autoRedirect, ok := options["autoredirect"].(bool); ok {
+		opts.autoRedirect = autoRedirect
+	}
+	if autoRedirectPath, ok := options["autoredirectpath"].(string); ok {
+		opts.autoRedirectPath = autoRedirectPath
+	}
 
 	return opts, nil
 }
@@ -168,99 +241,129 @@ func newAccessController(options map[string]interface{}) (auth.AccessController,
 		return nil, err
 	}
 
-	fp, err := os.Open(config.rootCertBundle)
-	if err != nil {
-		return nil, fmt.Errorf("unable to open token auth root certificate bundle file %q: %s", config.rootCertBundle, err)
+	var keyProvider TrustedKeyProvider
+	if config.jwks != "" {
+		keyProvider, err = newJWKSKeyProvider(config.jwks, config.jwksRefreshInterval, config.jwksCACertBundle)
+	} else {
+		keyProvider, err = newPEMBundleKeyProvider(config.rootCertBundle)
 	}
-	defer fp.Close()
-
-	rawCertBundle, err := ioutil.ReadAll(fp)
 	if err != nil {
-		return nil, fmt.Errorf("unable to read token auth root certificate bundle file %q: %s", config.rootCertBundle, err)
-	}
-
-	var rootCerts []*x509.Certificate
-	pemBlock, rawCertBundle := pem.Decode(rawCertBundle)
-	for pemBlock != nil {
-		cert, err := x509.ParseCertificate(pemBlock.Bytes)
-		if err != nil {
-			return nil, fmt.Errorf("unable to parse token auth root certificate: %s", err)
-		}
-
-		rootCerts = append(rootCerts, cert)
-
-		pemBlock, rawCertBundle = pem.Decode(rawCertBundle)
+		return nil, err
 	}
 
-	if len(rootCerts) == 0 {
-		return nil, errors.New("token auth requires at least one token signing root certificate")
-	}
+	bearer := newBearerSchemeHandler(config.realm, config.issuer, config.service, keyProvider)
+	schemes := []SchemeHandler{bearer}
 
-	rootPool := x509.NewCertPool()
-	trustedKeys := make(map[string]libtrust.PublicKey, len(rootCerts))
-	for _, rootCert := range rootCerts {
-		rootPool.AddCert(rootCert)
-		pubKey, err := libtrust.FromCryptoPublicKey(crypto.PublicKey(rootCert.PublicKey))
+	for _, factory := range extraSchemeHandlerFactories {
+		handler, err := factory(config.realm, config.issuer, config.service)
 		if err != nil {
-			return nil, fmt.Errorf("unable to get public key from token auth root certificate: %s", err)
+			return nil, err
 		}
-		trustedKeys[pubKey.KeyID()] = pubKey
+		schemes = append(schemes, handler)
 	}
 
 	return &accessController{
-		realm:       config.realm,
-		issuer:      config.issuer,
-		service:     config.service,
-		rootCerts:   rootPool,
-		trustedKeys: trustedKeys,
+		realm:            config.realm,
+		issuer:           config.issuer,
+		service:          config.service,
+		schemes:          schemes,
+		autoRedirect:     config.autoRedirect,
+		autoRedirectPath: config.autoRedirectPath,
 	}, nil
 }
 
-// Authorized handles checking whether the given request is authorized
-// for actions on resources described by the given access items.
-func (ac *accessController) Authorized(req *http.Request, accessItems ...auth.Access) error {
+// SchemeHandlerFactory constructs an additional SchemeHandler for an
+// accessController being built with the given realm, issuer, and service.
+type SchemeHandlerFactory func(realm, issuer, service string) (SchemeHandler, error)
+
+// extraSchemeHandlerFactories holds the factories registered via
+// RegisterSchemeHandler, tried in registration order after the built-in
+// Bearer handler.
+var extraSchemeHandlerFactories []SchemeHandlerFactory
+
+// RegisterSchemeHandler adds factory to the handlers every accessController
+// is constructed with from then on. This is the extension point the
+// chained-scheme model needs: only the Bearer JWT handler ships built in, so
+// an operator adding a second scheme, such as Basic-for-refresh-token or
+// mTLS client certificates, registers a factory here instead of forking
+// newAccessController. Schemes are tried, and challenged for, in
+// registration order after Bearer.
+func RegisterSchemeHandler(factory SchemeHandlerFactory) {
+	extraSchemeHandlerFactories = append(extraSchemeHandlerFactories, factory)
+}
+
+// Authorized handles checking whether the given request is authorized for
+// actions on resources described by the given access items. It tries each
+// of its registered SchemeHandlers, in order, against whichever scheme
+// challenges are present on the request's Authorization header. On success
+// it returns a context carrying an auth.UserInfo for the authenticated
+// subject under the "auth.user" key, so downstream handlers can log who
+// made the request.
+func (ac *accessController) Authorized(ctx context.Context, req *http.Request, accessItems ...auth.Access) (context.Context, error) {
 	challenge := &authChallenge{
-		realm:     ac.realm,
-		service:   ac.service,
-		accessSet: newAccessSet(accessItems...),
+		realm:            ac.realm,
+		service:          ac.service,
+		accessSet:        newAccessSet(accessItems...),
+		schemes:          ac.schemes,
+		autoRedirect:     ac.autoRedirect,
+		autoRedirectPath: ac.autoRedirectPath,
 	}
 
-	parts := strings.Split(req.Header.Get("Authorization"), " ")
+	parsedChallenges := parseAuthorizationHeader(req.Header.Get("Authorization"))
 
-	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
-		challenge.err = ErrTokenRequired
-		return challenge
-	}
+	var subject Subject
+schemeLoop:
+	for _, scheme := range ac.schemes {
+		for _, parsed := range parsedChallenges {
+			if !strings.EqualFold(parsed.scheme, scheme.Scheme()) {
+				continue
+			}
 
-	rawToken := parts[1]
+			s, err := scheme.Authenticate(req, parsed.params)
+			if err != nil {
+				challenge.err = err
+				return nil, challenge
+			}
 
-	token, err := NewToken(rawToken)
-	if err != nil {
-		challenge.err = err
-		return challenge
+			subject = s
+			break schemeLoop
+		}
 	}
 
-	verifyOpts := VerifyOptions{
-		TrustedIssuers:    collections.NewStringSet(ac.issuer),
-		AcceptedAudiences: collections.NewStringSet(ac.service),
-		Roots:             ac.rootCerts,
-		TrustedKeys:       ac.trustedKeys,
+	if subject == nil {
+		challenge.err = ErrTokenRequired
+		return nil, challenge
 	}
 
-	if err = token.Verify(verifyOpts); err != nil {
-		challenge.err = err
-		return challenge
+	// Default to granting nothing: a Subject must explicitly state what it
+	// was granted via scopedSubject, rather than being assumed to have
+	// earned everything it asked for just by authenticating successfully.
+	grantedAccess := newAccessSet()
+	if scoped, ok := subject.(scopedSubject); ok {
+		grantedAccess = scoped.grantedAccess()
+	}
+
+	if holder, ok := subject.(claimsSubject); ok {
+		if authorizer := getClaimsAuthorizer(); authorizer != nil {
+			authorized, err := authorizer.Authorize(holder.claims(), accessItems)
+			if err != nil {
+				challenge.err = err
+				return nil, challenge
+			}
+			grantedAccess = newAccessSet(authorized...)
+		}
 	}
 
-	accessSet := token.accessSet()
 	for _, access := range accessItems {
-		if !accessSet.contains(access) {
+		if !grantedAccess.contains(access) {
 			challenge.err = ErrInsufficientScope
-			return challenge
+			return nil, challenge
 		}
 	}
 
-	return nil
+	ctx = context.WithValue(ctx, "auth.user", auth.UserInfo{Name: subject.Name()})
+
+	return ctx, nil
 }
 
 // init handles registering the token auth backend.
@@ -0,0 +1,232 @@
+package token
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/docker/distribution/auth"
+)
+
+func TestCheckOptionsRequiresExactlyOneKeySource(t *testing.T) {
+	base := map[string]interface{}{
+		"realm":   "realm",
+		"issuer":  "issuer",
+		"service": "service",
+	}
+
+	withOption := func(key string, val interface{}) map[string]interface{} {
+		opts := make(map[string]interface{}, len(base)+1)
+		for k, v := range base {
+			opts[k] = v
+		}
+		opts[key] = val
+		return opts
+	}
+
+	cases := []struct {
+		name    string
+		options map[string]interface{}
+		wantErr bool
+	}{
+		{name: "neither rootCertBundle nor jwks", options: base, wantErr: true},
+		{name: "rootCertBundle only", options: withOption("rootCertBundle", "bundle.pem"), wantErr: false},
+		{name: "jwks only", options: withOption("jwks", "https://issuer.example.com/jwks"), wantErr: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := checkOptions(c.options)
+			if (err != nil) != c.wantErr {
+				t.Errorf("checkOptions(%v) error = %v, wantErr %v", c.options, err, c.wantErr)
+			}
+		})
+	}
+
+	both := withOption("rootCertBundle", "bundle.pem")
+	both["jwks"] = "https://issuer.example.com/jwks"
+	if _, err := checkOptions(both); err == nil {
+		t.Error("checkOptions with both rootCertBundle and jwks set: got nil error, want error")
+	}
+}
+
+// fakeSchemeHandler is a minimal SchemeHandler stand-in for a second scheme
+// registered via RegisterSchemeHandler, e.g. Basic-for-refresh-token.
+type fakeSchemeHandler struct {
+	scheme string
+}
+
+func (f fakeSchemeHandler) Scheme() string { return f.scheme }
+
+func (f fakeSchemeHandler) Authenticate(req *http.Request, params map[string]string) (Subject, error) {
+	return fakeSubject{name: params["token"]}, nil
+}
+
+func (f fakeSchemeHandler) Challenge(accessSet accessSet) string {
+	return `realm="fake"`
+}
+
+type fakeSubject struct {
+	name string
+}
+
+func (s fakeSubject) Name() string { return s.name }
+
+// TestAccessControllerNegotiatesMultipleSchemes exercises accessController
+// with more than one SchemeHandler, the configuration RegisterSchemeHandler
+// exists to make reachable: it picks whichever registered scheme matches
+// the Authorization header, and challenges with one WWW-Authenticate header
+// per scheme when none matches.
+func TestAccessControllerNegotiatesMultipleSchemes(t *testing.T) {
+	ac := &accessController{
+		realm:   "test-realm",
+		service: "test-service",
+		schemes: []SchemeHandler{
+			newBearerSchemeHandler("test-realm", "test-issuer", "test-service", &pemBundleKeyProvider{}),
+			fakeSchemeHandler{scheme: "Fake"},
+		},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", `Fake user-a`)
+
+	ctx, err := ac.Authorized(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Authorized with second scheme's header: got error %v, want nil", err)
+	}
+	if userInfo, _ := ctx.Value("auth.user").(auth.UserInfo); userInfo.Name != "user-a" {
+		t.Errorf("Authorized subject = %+v, want Name %q", userInfo, "user-a")
+	}
+
+	noAuthReq := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+
+	if _, err := ac.Authorized(context.Background(), noAuthReq); err == nil {
+		t.Fatal("Authorized with no Authorization header: got nil error, want a challenge")
+	} else if challenge, ok := err.(*authChallenge); ok {
+		challenge.SetHeader(noAuthReq, w.Header())
+	} else {
+		t.Fatalf("Authorized error type = %T, want *authChallenge", err)
+	}
+
+	if got := len(w.Header()["Www-Authenticate"]); got != len(ac.schemes) {
+		t.Errorf("got %d WWW-Authenticate headers, want one per scheme (%d)", got, len(ac.schemes))
+	}
+}
+
+func TestCheckOptionsParsesAutoRedirect(t *testing.T) {
+	options := map[string]interface{}{
+		"realm":            "realm",
+		"issuer":           "issuer",
+		"service":          "service",
+		"rootCertBundle":   "bundle.pem",
+		"autoredirect":     true,
+		"autoredirectpath": "/token",
+	}
+
+	opts, err := checkOptions(options)
+	if err != nil {
+		t.Fatalf("checkOptions: %s", err)
+	}
+	if !opts.autoRedirect {
+		t.Error("autoRedirect = false, want true")
+	}
+	if opts.autoRedirectPath != "/token" {
+		t.Errorf("autoRedirectPath = %q, want %q", opts.autoRedirectPath, "/token")
+	}
+}
+
+func TestCheckOptionsAutoRedirectDefaultsOff(t *testing.T) {
+	options := map[string]interface{}{
+		"realm":          "realm",
+		"issuer":         "issuer",
+		"service":        "service",
+		"rootCertBundle": "bundle.pem",
+	}
+
+	opts, err := checkOptions(options)
+	if err != nil {
+		t.Fatalf("checkOptions: %s", err)
+	}
+	if opts.autoRedirect {
+		t.Error("autoRedirect = true, want false when unset")
+	}
+	if opts.autoRedirectPath != "" {
+		t.Errorf("autoRedirectPath = %q, want empty when unset", opts.autoRedirectPath)
+	}
+}
+
+func TestAuthChallengeAutoRedirect(t *testing.T) {
+	ac := &authChallenge{
+		err:     ErrTokenRequired,
+		realm:   "test-realm",
+		service: "test-service",
+		accessSet: newAccessSet(auth.Access{
+			Resource: auth.Resource{Type: "repository", Name: "foo"},
+			Action:   "pull",
+		}),
+		autoRedirect:     true,
+		autoRedirectPath: "/token",
+	}
+
+	if got := ac.Status(); got != http.StatusFound {
+		t.Errorf("Status() = %d, want %d", got, http.StatusFound)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/foo/manifests/latest", nil)
+	req.Host = "registry.example.com"
+	w := httptest.NewRecorder()
+
+	ac.SetHeader(req, w.Header())
+
+	if got := w.Header().Get("WWW-Authenticate"); got != "" {
+		t.Errorf("auto-redirect challenge set WWW-Authenticate = %q, want none", got)
+	}
+
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("parsing Location header: %s", err)
+	}
+
+	if loc.Scheme != "https" || loc.Host != "registry.example.com" || loc.Path != "/token" {
+		t.Errorf("Location = %q, want scheme https, host registry.example.com, path /token", loc)
+	}
+
+	q := loc.Query()
+	if got := q.Get("service"); got != "test-service" {
+		t.Errorf("Location service param = %q, want %q", got, "test-service")
+	}
+	if got := q.Get("client_id"); got != "test-service" {
+		t.Errorf("Location client_id param = %q, want %q", got, "test-service")
+	}
+	if got := q.Get("scope"); got != "repository:foo:pull" {
+		t.Errorf("Location scope param = %q, want %q", got, "repository:foo:pull")
+	}
+}
+
+func TestAuthChallengeNoAutoRedirect(t *testing.T) {
+	ac := &authChallenge{
+		err:     ErrTokenRequired,
+		realm:   "test-realm",
+		service: "test-service",
+		schemes: []SchemeHandler{newBearerSchemeHandler("test-realm", "test-issuer", "test-service", &pemBundleKeyProvider{})},
+	}
+
+	if got := ac.Status(); got != http.StatusUnauthorized {
+		t.Errorf("Status() = %d, want %d", got, http.StatusUnauthorized)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	ac.SetHeader(req, w.Header())
+
+	if got := w.Header().Get("Location"); got != "" {
+		t.Errorf("non-redirect challenge set Location = %q, want none", got)
+	}
+	if got := w.Header().Get("WWW-Authenticate"); got == "" {
+		t.Error("non-redirect challenge: expected a WWW-Authenticate header")
+	}
+}
@@ -0,0 +1,34 @@
+package token
+
+import (
+	"github.com/docker/distribution/auth"
+)
+
+// ClaimsAuthorizer is consulted by accessController.Authorized once a
+// token's signature, issuer, and audience have all verified successfully.
+// It receives the token's decoded claims along with the access originally
+// requested, and returns the access the subject is actually granted, which
+// may be a subset of what was requested. Implementations can use this hook
+// to back authorization with an external policy engine (e.g. OPA/Rego) or a
+// per-repo ACL database, rather than trusting the access list embedded in
+// the token alone.
+type ClaimsAuthorizer interface {
+	Authorize(claims *ClaimSet, access []auth.Access) ([]auth.Access, error)
+}
+
+// claimsAuthorizer holds the currently registered ClaimsAuthorizer, if any.
+var claimsAuthorizer ClaimsAuthorizer
+
+// RegisterClaimsAuthorizer installs a ClaimsAuthorizer to be consulted by
+// every accessController after a token's claims have been verified. Only
+// one authorizer can be registered at a time; registering again replaces
+// the previous one.
+func RegisterClaimsAuthorizer(authorizer ClaimsAuthorizer) {
+	claimsAuthorizer = authorizer
+}
+
+// getClaimsAuthorizer returns the currently registered ClaimsAuthorizer, or
+// nil if none has been registered.
+func getClaimsAuthorizer() ClaimsAuthorizer {
+	return claimsAuthorizer
+}
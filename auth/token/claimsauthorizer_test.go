@@ -0,0 +1,39 @@
+package token_test
+
+import (
+	"testing"
+
+	"github.com/docker/distribution/auth"
+	"github.com/docker/distribution/auth/token"
+)
+
+// fakeExternalAuthorizer models a ClaimsAuthorizer backed by an external
+// policy engine or ACL database, implemented outside the token package
+// using only its exported API.
+type fakeExternalAuthorizer struct {
+	grant []auth.Access
+}
+
+func (f fakeExternalAuthorizer) Authorize(claims *token.ClaimSet, requested []auth.Access) ([]auth.Access, error) {
+	return f.grant, nil
+}
+
+// TestClaimsAuthorizerImplementableExternally asserts that ClaimsAuthorizer
+// can actually be implemented by a package outside token, which requires
+// every type in its method signature to be exported.
+func TestClaimsAuthorizerImplementableExternally(t *testing.T) {
+	var _ token.ClaimsAuthorizer = fakeExternalAuthorizer{}
+
+	grant := []auth.Access{{Resource: auth.Resource{Type: "repository", Name: "foo"}, Action: "pull"}}
+	authorizer := fakeExternalAuthorizer{grant: grant}
+
+	got, err := authorizer.Authorize(&token.ClaimSet{Subject: "user"}, nil)
+	if err != nil {
+		t.Fatalf("Authorize: %s", err)
+	}
+	if len(got) != 1 || got[0] != grant[0] {
+		t.Errorf("Authorize() = %+v, want %+v", got, grant)
+	}
+
+	token.RegisterClaimsAuthorizer(authorizer)
+}
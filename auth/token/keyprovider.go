@@ -0,0 +1,254 @@
+package token
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/docker/libtrust"
+)
+
+// defaultJWKSRefreshInterval is used when jwksRefreshInterval is not set.
+const defaultJWKSRefreshInterval = 5 * time.Minute
+
+// TrustedKeyProvider supplies the set of public keys an accessController
+// trusts to have signed bearer tokens, keyed by key ID ("kid"), along with
+// any x509 roots a token's embedded certificate chain should validate
+// against. Implementations may refresh their snapshot in the background
+// (see jwksKeyProvider), allowing issuer keys to be rotated without
+// restarting the registry.
+type TrustedKeyProvider interface {
+	// TrustedKeys returns the current snapshot of trusted keys, keyed by
+	// key ID.
+	TrustedKeys() map[string]libtrust.PublicKey
+
+	// Roots returns the x509 root certificate pool to validate an embedded
+	// certificate chain against, or nil if this provider has none.
+	Roots() *x509.CertPool
+}
+
+// pemBundleKeyProvider is a TrustedKeyProvider backed by a single,
+// load-once PEM root certificate bundle file. This is the original,
+// static trust model supported by this package.
+type pemBundleKeyProvider struct {
+	rootCerts   *x509.CertPool
+	trustedKeys map[string]libtrust.PublicKey
+}
+
+// newPEMBundleKeyProvider loads the token signing root certificates from
+// bundlePath and returns a TrustedKeyProvider backed by them.
+func newPEMBundleKeyProvider(bundlePath string) (*pemBundleKeyProvider, error) {
+	rootCerts, err := loadCertBundle(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+
+	rootPool := x509.NewCertPool()
+	trustedKeys := make(map[string]libtrust.PublicKey, len(rootCerts))
+	for _, rootCert := range rootCerts {
+		rootPool.AddCert(rootCert)
+		pubKey, err := libtrust.FromCryptoPublicKey(crypto.PublicKey(rootCert.PublicKey))
+		if err != nil {
+			return nil, fmt.Errorf("unable to get public key from token auth root certificate: %s", err)
+		}
+		trustedKeys[pubKey.KeyID()] = pubKey
+	}
+
+	return &pemBundleKeyProvider{rootCerts: rootPool, trustedKeys: trustedKeys}, nil
+}
+
+func (p *pemBundleKeyProvider) TrustedKeys() map[string]libtrust.PublicKey {
+	return p.trustedKeys
+}
+
+func (p *pemBundleKeyProvider) Roots() *x509.CertPool {
+	return p.rootCerts
+}
+
+// loadCertBundle reads and parses every PEM-encoded certificate in the file
+// at bundlePath.
+func loadCertBundle(bundlePath string) ([]*x509.Certificate, error) {
+	fp, err := os.Open(bundlePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open token auth root certificate bundle file %q: %s", bundlePath, err)
+	}
+	defer fp.Close()
+
+	rawCertBundle, err := ioutil.ReadAll(fp)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token auth root certificate bundle file %q: %s", bundlePath, err)
+	}
+
+	var certs []*x509.Certificate
+	pemBlock, rawCertBundle := pem.Decode(rawCertBundle)
+	for pemBlock != nil {
+		cert, err := x509.ParseCertificate(pemBlock.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse token auth root certificate: %s", err)
+		}
+
+		certs = append(certs, cert)
+
+		pemBlock, rawCertBundle = pem.Decode(rawCertBundle)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("token auth requires at least one token signing root certificate")
+	}
+
+	return certs, nil
+}
+
+// jwksKeyProvider is a TrustedKeyProvider that periodically polls a JWKS
+// endpoint for the issuer's current signing keys. A failed refresh keeps
+// serving the last known-good snapshot, so a transient JWKS outage never
+// breaks token verification.
+type jwksKeyProvider struct {
+	jwksURI string
+	client  *http.Client
+
+	mu           sync.RWMutex
+	trustedKeys  map[string]libtrust.PublicKey
+	etag         string
+	lastModified string
+
+	done chan struct{}
+}
+
+// newJWKSKeyProvider fetches the initial key set from jwksURI and starts a
+// background poll at refreshInterval (or defaultJWKSRefreshInterval, if
+// zero). If caCertBundle is non-empty, it is used as the trusted root set
+// for the HTTPS connection to jwksURI.
+func newJWKSKeyProvider(jwksURI string, refreshInterval time.Duration, caCertBundle string) (*jwksKeyProvider, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	if caCertBundle != "" {
+		caCerts, err := loadCertBundle(caCertBundle)
+		if err != nil {
+			return nil, err
+		}
+
+		caPool := x509.NewCertPool()
+		for _, caCert := range caCerts {
+			caPool.AddCert(caCert)
+		}
+
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caPool}}
+	}
+
+	p := &jwksKeyProvider{jwksURI: jwksURI, client: client, done: make(chan struct{})}
+	if err := p.refresh(); err != nil {
+		return nil, fmt.Errorf("unable to fetch initial JWKS from %q: %s", jwksURI, err)
+	}
+
+	if refreshInterval <= 0 {
+		refreshInterval = defaultJWKSRefreshInterval
+	}
+
+	go p.poll(refreshInterval)
+
+	return p, nil
+}
+
+// poll refreshes the key set every interval until Close is called. Errors
+// are dropped on the floor: refresh already preserves the previous snapshot
+// on failure, and there is no caller left to report to from a background
+// goroutine.
+func (p *jwksKeyProvider) poll(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.refresh()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// Close stops the background poll goroutine. Callers that replace a
+// jwksKeyProvider, e.g. an accessController rebuilt on config reload, must
+// Close the old provider or it leaks a goroutine polling a JWKS endpoint
+// nothing uses anymore.
+func (p *jwksKeyProvider) Close() {
+	close(p.done)
+}
+
+// refresh fetches the latest JWKS document, using If-None-Match/
+// If-Modified-Since so an unchanged key set costs only a round trip. On any
+// error, the previously loaded trustedKeys snapshot is left in place.
+func (p *jwksKeyProvider) refresh() error {
+	req, err := http.NewRequest(http.MethodGet, p.jwksURI, nil)
+	if err != nil {
+		return err
+	}
+
+	p.mu.RLock()
+	if p.etag != "" {
+		req.Header.Set("If-None-Match", p.etag)
+	}
+	if p.lastModified != "" {
+		req.Header.Set("If-Modified-Since", p.lastModified)
+	}
+	p.mu.RUnlock()
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status fetching JWKS: %s", resp.Status)
+	}
+
+	var jwks struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return err
+	}
+
+	trustedKeys := make(map[string]libtrust.PublicKey, len(jwks.Keys))
+	for _, rawKey := range jwks.Keys {
+		key, err := libtrust.UnmarshalPublicKeyJWK(rawKey)
+		if err != nil {
+			return fmt.Errorf("unable to parse JWKS key: %s", err)
+		}
+		trustedKeys[key.KeyID()] = key
+	}
+
+	p.mu.Lock()
+	p.trustedKeys = trustedKeys
+	p.etag = resp.Header.Get("ETag")
+	p.lastModified = resp.Header.Get("Last-Modified")
+	p.mu.Unlock()
+
+	return nil
+}
+
+func (p *jwksKeyProvider) TrustedKeys() map[string]libtrust.PublicKey {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.trustedKeys
+}
+
+// Roots always returns nil: a JWKS document carries no x509 trust roots,
+// only the signing keys themselves.
+func (p *jwksKeyProvider) Roots() *x509.CertPool {
+	return nil
+}
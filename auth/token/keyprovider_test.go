@@ -0,0 +1,48 @@
+package token
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/libtrust"
+)
+
+func TestJWKSKeyProviderCloseStopsPolling(t *testing.T) {
+	key, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatalf("unable to generate test key: %s", err)
+	}
+
+	jwk, err := key.PublicKey().MarshalJSON()
+	if err != nil {
+		t.Fatalf("unable to marshal test key: %s", err)
+	}
+
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Keys []json.RawMessage `json:"keys"`
+		}{Keys: []json.RawMessage{jwk}})
+	}))
+	defer server.Close()
+
+	p, err := newJWKSKeyProvider(server.URL, 10*time.Millisecond, "")
+	if err != nil {
+		t.Fatalf("newJWKSKeyProvider: %s", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	p.Close()
+
+	hitsAtClose := atomic.LoadInt32(&hits)
+	time.Sleep(50 * time.Millisecond)
+	if got := atomic.LoadInt32(&hits); got != hitsAtClose {
+		t.Errorf("poll goroutine kept running after Close: %d hits at Close, %d after waiting", hitsAtClose, got)
+	}
+}
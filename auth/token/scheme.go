@@ -0,0 +1,214 @@
+package token
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/docker/distribution/collections"
+)
+
+// Subject identifies the authenticated caller of a request, as determined
+// by whichever SchemeHandler verified its credential.
+type Subject interface {
+	// Name returns the subject's identity, used for UserInfo and audit
+	// logging.
+	Name() string
+}
+
+// scopedSubject is implemented by Subjects that carry their own verified
+// access grants, such as the bearer scheme's JWT claims. accessController
+// consults it instead of assuming a successfully authenticated subject was
+// granted every item it requested.
+type scopedSubject interface {
+	grantedAccess() accessSet
+}
+
+// claimsSubject is implemented by Subjects backed by a JWT ClaimSet, so the
+// ClaimsAuthorizer registered via RegisterClaimsAuthorizer can run against
+// it after authentication.
+type claimsSubject interface {
+	claims() *ClaimSet
+}
+
+// SchemeHandler implements verification for a single auth-scheme that may
+// appear in an Authorization header, such as "Bearer" or "Basic".
+// accessController tries its registered handlers, in the order given at
+// construction, against whichever scheme challenges are present on the
+// incoming request, and advertises one WWW-Authenticate header per handler
+// when a request is rejected.
+type SchemeHandler interface {
+	// Scheme returns the auth-scheme token this handler verifies, e.g.
+	// "Bearer".
+	Scheme() string
+
+	// Authenticate verifies the credential carried by params, the
+	// parameters parsed from this scheme's segment of the Authorization
+	// header, and returns the authenticated Subject.
+	Authenticate(req *http.Request, params map[string]string) (Subject, error)
+
+	// Challenge returns this handler's scheme-specific WWW-Authenticate
+	// parameters (everything after the scheme name) for the given
+	// requested access.
+	Challenge(accessSet accessSet) string
+}
+
+// bearerSchemeHandler implements SchemeHandler for the Bearer JWT scheme
+// that this package has always supported.
+type bearerSchemeHandler struct {
+	realm       string
+	issuer      string
+	service     string
+	keyProvider TrustedKeyProvider
+}
+
+// newBearerSchemeHandler returns a SchemeHandler that verifies Bearer JWTs
+// issued by issuer, using keyProvider's current snapshot to look up the
+// signing key for each token by its "kid" header.
+func newBearerSchemeHandler(realm, issuer, service string, keyProvider TrustedKeyProvider) *bearerSchemeHandler {
+	return &bearerSchemeHandler{
+		realm:       realm,
+		issuer:      issuer,
+		service:     service,
+		keyProvider: keyProvider,
+	}
+}
+
+// Scheme implements SchemeHandler.
+func (b *bearerSchemeHandler) Scheme() string {
+	return "Bearer"
+}
+
+// Authenticate implements SchemeHandler by verifying the JWT carried as a
+// bare credential in the Bearer scheme (i.e. "Bearer <token>").
+func (b *bearerSchemeHandler) Authenticate(req *http.Request, params map[string]string) (Subject, error) {
+	rawToken := params["token"]
+	if rawToken == "" {
+		return nil, ErrTokenRequired
+	}
+
+	token, err := NewToken(rawToken)
+	if err != nil {
+		return nil, err
+	}
+
+	verifyOpts := VerifyOptions{
+		TrustedIssuers:    collections.NewStringSet(b.issuer),
+		AcceptedAudiences: collections.NewStringSet(b.service),
+		Roots:             b.keyProvider.Roots(),
+		TrustedKeys:       b.keyProvider.TrustedKeys(),
+	}
+
+	if err := token.Verify(verifyOpts); err != nil {
+		return nil, err
+	}
+
+	return &bearerSubject{claimSet: token.Claims, access: token.accessSet()}, nil
+}
+
+// Challenge implements SchemeHandler.
+// See https://tools.ietf.org/html/rfc6750#section-3
+func (b *bearerSchemeHandler) Challenge(accessSet accessSet) string {
+	str := fmt.Sprintf("realm=%q,service=%q", b.realm, b.service)
+
+	if scope := accessSet.scopeParam(); scope != "" {
+		str = fmt.Sprintf("%s,scope=%q", str, scope)
+	}
+
+	return str
+}
+
+// bearerSubject is the Subject produced by bearerSchemeHandler: a verified
+// JWT's claims together with the access it grants.
+type bearerSubject struct {
+	claimSet *ClaimSet
+	access   accessSet
+}
+
+func (s *bearerSubject) Name() string             { return s.claimSet.Subject }
+func (s *bearerSubject) grantedAccess() accessSet { return s.access }
+func (s *bearerSubject) claims() *ClaimSet        { return s.claimSet }
+
+// authParams holds one scheme challenge parsed from an Authorization
+// header: the auth-scheme name and its associated parameters. Schemes that
+// carry a single opaque credential, such as "Bearer <token>", have that
+// credential stored under the reserved "token" key rather than as a
+// key=value pair.
+type authParams struct {
+	scheme string
+	params map[string]string
+}
+
+var (
+	schemeTokenRegexp = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9!#$%&'*+\-.^_` + "`" + `|~]*)\s*`)
+	authParamRegexp   = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9!#$%&'*+\-.^_` + "`" + `|~]*)=(?:"((?:[^"\\]|\\.)*)"|([^\s,]+))\s*,?\s*`)
+
+	// token68Regexp matches the "token68" production of RFC 7235 section
+	// 2.1, the bare-credential form a scheme like "Bearer <jwt>" uses in
+	// place of key=value params. Its charset excludes "," and whitespace, so
+	// it never runs into a following scheme.
+	token68Regexp = regexp.MustCompile(`^[a-zA-Z0-9\-._~+/]+=*`)
+)
+
+// parseAuthorizationHeader splits the value of an Authorization header into
+// one or more scheme challenges, per RFC 7235 section 2.1, tolerating
+// quoted-string parameter values that may themselves contain commas.
+func parseAuthorizationHeader(header string) []authParams {
+	header = strings.TrimSpace(header)
+
+	var challenges []authParams
+	for header != "" {
+		m := schemeTokenRegexp.FindStringSubmatchIndex(header)
+		if m == nil {
+			break
+		}
+
+		scheme := header[m[2]:m[3]]
+		rest := header[m[1]:]
+		params := make(map[string]string)
+
+		consumed := 0
+		for {
+			pm := authParamRegexp.FindStringSubmatchIndex(rest[consumed:])
+			if pm == nil {
+				break
+			}
+
+			key := rest[consumed+pm[2] : consumed+pm[3]]
+
+			var val string
+			if pm[4] >= 0 {
+				val = strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(rest[consumed+pm[4] : consumed+pm[5]])
+			} else {
+				val = rest[consumed+pm[6] : consumed+pm[7]]
+			}
+
+			params[key] = val
+			consumed += pm[1]
+		}
+
+		if consumed == 0 {
+			// No "key=value" pairs follow: this scheme carries a bare
+			// token68 credential (e.g. "Bearer <token>"), which ends at the
+			// next comma-separated scheme, if any.
+			tm := token68Regexp.FindStringIndex(rest)
+			if tm == nil {
+				break
+			}
+
+			params["token"] = rest[tm[0]:tm[1]]
+			challenges = append(challenges, authParams{scheme: scheme, params: params})
+
+			header = strings.TrimSpace(rest[tm[1]:])
+			header = strings.TrimPrefix(header, ",")
+			header = strings.TrimSpace(header)
+			continue
+		}
+
+		challenges = append(challenges, authParams{scheme: scheme, params: params})
+		header = strings.TrimSpace(rest[consumed:])
+	}
+
+	return challenges
+}
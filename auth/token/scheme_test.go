@@ -0,0 +1,55 @@
+package token
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAuthorizationHeader(t *testing.T) {
+	cases := []struct {
+		name   string
+		header string
+		want   []authParams
+	}{
+		{
+			name:   "single bare credential",
+			header: `Bearer abc.def.ghi`,
+			want: []authParams{
+				{scheme: "Bearer", params: map[string]string{"token": "abc.def.ghi"}},
+			},
+		},
+		{
+			name:   "bare credential followed by key=value scheme",
+			header: `Bearer abc.def.ghi, Basic realm="x"`,
+			want: []authParams{
+				{scheme: "Bearer", params: map[string]string{"token": "abc.def.ghi"}},
+				{scheme: "Basic", params: map[string]string{"realm": "x"}},
+			},
+		},
+		{
+			name:   "key=value scheme followed by bare credential",
+			header: `Basic realm="x", Bearer abc.def.ghi`,
+			want: []authParams{
+				{scheme: "Basic", params: map[string]string{"realm": "x"}},
+				{scheme: "Bearer", params: map[string]string{"token": "abc.def.ghi"}},
+			},
+		},
+		{
+			name:   "multiple key=value schemes",
+			header: `Basic realm="x", Bearer realm="y",service="z"`,
+			want: []authParams{
+				{scheme: "Basic", params: map[string]string{"realm": "x"}},
+				{scheme: "Bearer", params: map[string]string{"realm": "y", "service": "z"}},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := parseAuthorizationHeader(c.header)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("parseAuthorizationHeader(%q) = %#v, want %#v", c.header, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/docker/distribution/auth"
+	"github.com/docker/distribution/auth/token"
+)
+
+// parseScope parses a "resource:name:actions[ resource:name:actions...]"
+// scope string, the same grammar accessSet.scopeParam produces for a
+// WWW-Authenticate challenge, into the auth.Access items it requests.
+func parseScope(scope string) []auth.Access {
+	var requested []auth.Access
+
+	for _, s := range strings.Fields(scope) {
+		parts := strings.SplitN(s, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+
+		resourceType, resourceName, actions := parts[0], parts[1], parts[2]
+		for _, action := range strings.Split(actions, ",") {
+			if action == "" {
+				continue
+			}
+
+			requested = append(requested, auth.Access{
+				Resource: auth.Resource{Type: resourceType, Name: resourceName},
+				Action:   action,
+			})
+		}
+	}
+
+	return requested
+}
+
+// accessToResourceActions groups access items by resource, the shape
+// token.ClaimSet expects for its "access" claim.
+func accessToResourceActions(access []auth.Access) []*token.ResourceActions {
+	var order []auth.Resource
+	grouped := make(map[auth.Resource][]string)
+
+	for _, a := range access {
+		if _, ok := grouped[a.Resource]; !ok {
+			order = append(order, a.Resource)
+		}
+		grouped[a.Resource] = append(grouped[a.Resource], a.Action)
+	}
+
+	resourceActions := make([]*token.ResourceActions, 0, len(order))
+	for _, resource := range order {
+		resourceActions = append(resourceActions, &token.ResourceActions{
+			Type:    resource.Type,
+			Name:    resource.Name,
+			Actions: grouped[resource],
+		})
+	}
+
+	return resourceActions
+}
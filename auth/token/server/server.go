@@ -0,0 +1,165 @@
+// Package server implements the registry token endpoint described by the
+// Docker Registry token authentication specification
+// (https://docs.docker.com/registry/spec/auth/token/), so that this module
+// can issue the bearer tokens its token.accessController verifies rather
+// than only checking ones minted elsewhere.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/docker/libtrust"
+
+	"github.com/docker/distribution/auth"
+)
+
+// defaultTokenExpiration is the lifetime of every token a Handler issues;
+// NewHandler takes no expiration of its own.
+const defaultTokenExpiration = 5 * time.Minute
+
+// PasswordAuthenticator authenticates the username/password pair presented
+// to the token endpoint, typically via HTTP Basic auth. Implementations
+// might check an htpasswd file, an LDAP directory, or any other user store.
+type PasswordAuthenticator interface {
+	// AuthenticateUser reports whether password is valid for username.
+	AuthenticateUser(username, password string) (bool, error)
+}
+
+// Authorizer narrows or denies the access requested by an authenticated
+// user before a token is minted for it, e.g. backing per-repo ACLs.
+// Implementations may return a subset of requested, but must not return
+// access the user did not request.
+type Authorizer interface {
+	Authorize(username string, requested []auth.Access) ([]auth.Access, error)
+}
+
+// RefreshTokenStore persists offline refresh tokens so a user can obtain
+// new bearer tokens without presenting their password again. Handler only
+// creates refresh tokens; it does not accept one in place of a password.
+type RefreshTokenStore interface {
+	// CreateRefreshToken mints and stores a new refresh token for username
+	// and service.
+	CreateRefreshToken(username, service string) (string, error)
+
+	// VerifyRefreshToken checks that refreshToken was issued to username
+	// for service and is still valid.
+	VerifyRefreshToken(refreshToken, username, service string) error
+}
+
+// Handler implements the registry token endpoint:
+//
+//	GET /token?service=&scope=&account=&client_id=&offline_token=
+//
+// It authenticates the caller, resolves the requested scopes to access
+// items, filters them through an Authorizer, and mints a bearer token
+// signed by signingKey.
+type Handler struct {
+	issuer     string
+	signingKey libtrust.PrivateKey
+	expiration time.Duration
+
+	authenticator PasswordAuthenticator
+	authorizer    Authorizer
+	refreshTokens RefreshTokenStore
+}
+
+// NewHandler returns a Handler that issues tokens for issuer, signed by
+// signingKey. signingKey's public key must be present in the verifying
+// accessController's trust store (its PEM root bundle or JWKS endpoint) for
+// the tokens to validate. authenticator and authorizer are required: the
+// authenticator checks the password of every caller that names a user, and
+// the authorizer decides what access to grant to every caller, including an
+// anonymous one, whose password is not checked. refreshTokens may be nil, in
+// which case offline_token requests are rejected.
+func NewHandler(issuer string, signingKey libtrust.PrivateKey, authenticator PasswordAuthenticator, authorizer Authorizer, refreshTokens RefreshTokenStore) (*Handler, error) {
+	if authenticator == nil {
+		return nil, errors.New("token server requires a PasswordAuthenticator")
+	}
+	if authorizer == nil {
+		return nil, errors.New("token server requires an Authorizer")
+	}
+
+	return &Handler{
+		issuer:        issuer,
+		signingKey:    signingKey,
+		expiration:    defaultTokenExpiration,
+		authenticator: authenticator,
+		authorizer:    authorizer,
+		refreshTokens: refreshTokens,
+	}, nil
+}
+
+// tokenResponse is the JSON body returned by the token endpoint, matching
+// what registry clients expect.
+type tokenResponse struct {
+	Token        string `json:"token"`
+	AccessToken  string `json:"access_token,omitempty"`
+	ExpiresIn    int    `json:"expires_in"`
+	IssuedAt     string `json:"issued_at"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	service := params.Get("service")
+	scope := params.Get("scope")
+	offlineToken := params.Get("offline_token") == "true"
+
+	username, password, haveBasicAuth := r.BasicAuth()
+	if !haveBasicAuth {
+		username = params.Get("account")
+	}
+
+	if username != "" {
+		ok, err := h.authenticator.AuthenticateUser(username, password)
+		if err != nil || !ok {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", h.issuer))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	requestedAccess := parseScope(scope)
+
+	grantedAccess, err := h.authorizer.Authorize(username, requestedAccess)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	rawToken, err := issueToken(h.signingKey, h.issuer, service, username, grantedAccess, h.expiration)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := tokenResponse{
+		Token:       rawToken,
+		AccessToken: rawToken,
+		ExpiresIn:   int(h.expiration.Seconds()),
+		IssuedAt:    time.Now().UTC().Format(time.RFC3339),
+	}
+
+	if offlineToken {
+		if h.refreshTokens == nil {
+			http.Error(w, "offline tokens are not supported", http.StatusNotImplemented)
+			return
+		}
+
+		refreshToken, err := h.refreshTokens.CreateRefreshToken(username, service)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		resp.RefreshToken = refreshToken
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
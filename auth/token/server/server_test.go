@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/docker/libtrust"
+
+	"github.com/docker/distribution/auth"
+	"github.com/docker/distribution/auth/token"
+)
+
+type fakeAuthenticator struct {
+	ok bool
+}
+
+func (f fakeAuthenticator) AuthenticateUser(username, password string) (bool, error) {
+	return f.ok, nil
+}
+
+type fakeAuthorizer struct {
+	grant []auth.Access
+}
+
+func (f fakeAuthorizer) Authorize(username string, requested []auth.Access) ([]auth.Access, error) {
+	return f.grant, nil
+}
+
+func newTestSigningKey(t *testing.T) libtrust.PrivateKey {
+	key, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatalf("unable to generate test signing key: %s", err)
+	}
+	return key
+}
+
+func TestNewHandlerRequiresAuthenticatorAndAuthorizer(t *testing.T) {
+	key := newTestSigningKey(t)
+
+	if _, err := NewHandler("issuer", key, nil, fakeAuthorizer{}, nil); err == nil {
+		t.Error("NewHandler with nil authenticator: got nil error, want error")
+	}
+
+	if _, err := NewHandler("issuer", key, fakeAuthenticator{ok: true}, nil, nil); err == nil {
+		t.Error("NewHandler with nil authorizer: got nil error, want error")
+	}
+
+	if _, err := NewHandler("issuer", key, fakeAuthenticator{ok: true}, fakeAuthorizer{}, nil); err != nil {
+		t.Errorf("NewHandler with both set: got error %s, want nil", err)
+	}
+}
+
+func TestServeHTTPAnonymousRequestIsAuthorized(t *testing.T) {
+	key := newTestSigningKey(t)
+
+	h, err := NewHandler("issuer", key, fakeAuthenticator{ok: true}, fakeAuthorizer{grant: nil}, nil)
+	if err != nil {
+		t.Fatalf("NewHandler: %s", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/token?service=registry&scope=repository:foo:push,pull", nil)
+	w := httptest.NewRecorder()
+
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("anonymous request: got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var resp tokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding response: %s", err)
+	}
+
+	claims := decodeClaimSet(t, resp.Token)
+	if len(claims.Access) != 0 {
+		t.Errorf("anonymous request granted access %+v, want none: a nil Authorizer grant must not fall back to the requested scope", claims.Access)
+	}
+}
+
+// decodeClaimSet decodes the JWT payload segment of rawToken without
+// verifying its signature, which is all a test needs to inspect what access
+// was actually minted into it.
+func decodeClaimSet(t *testing.T, rawToken string) token.ClaimSet {
+	t.Helper()
+
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		t.Fatalf("malformed token %q", rawToken)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatalf("decoding token payload: %s", err)
+	}
+
+	var claims token.ClaimSet
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatalf("unmarshaling claims: %s", err)
+	}
+
+	return claims
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/libtrust"
+
+	"github.com/docker/distribution/auth"
+	"github.com/docker/distribution/auth/token"
+)
+
+// joseHeader is the JOSE header of the compact JWTs this package issues.
+type joseHeader struct {
+	Type       string `json:"typ"`
+	SigningAlg string `json:"alg"`
+	KeyID      string `json:"kid"`
+}
+
+// issueToken signs and serializes a bearer token granting access for
+// subject to the given access, valid for expiration, with signingKey.
+func issueToken(signingKey libtrust.PrivateKey, issuer, service, subject string, access []auth.Access, expiration time.Duration) (string, error) {
+	jwtID, err := randomJWTID()
+	if err != nil {
+		return "", fmt.Errorf("unable to generate jti: %s", err)
+	}
+
+	now := time.Now()
+	claimSet := token.ClaimSet{
+		Issuer:     issuer,
+		Subject:    subject,
+		Audience:   service,
+		Expiration: now.Add(expiration).Unix(),
+		NotBefore:  now.Unix(),
+		IssuedAt:   now.Unix(),
+		JWTID:      jwtID,
+		Access:     accessToResourceActions(access),
+	}
+
+	header := joseHeader{
+		Type:       "JWT",
+		SigningAlg: signingAlgorithm(signingKey),
+		KeyID:      signingKey.KeyID(),
+	}
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal token header: %s", err)
+	}
+
+	claimsJSON, err := json.Marshal(claimSet)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal token claims: %s", err)
+	}
+
+	payload := fmt.Sprintf("%s.%s", joseBase64Encode(headerJSON), joseBase64Encode(claimsJSON))
+
+	sig, _, err := signingKey.Sign(strings.NewReader(payload), crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("unable to sign token: %s", err)
+	}
+
+	return fmt.Sprintf("%s.%s", payload, joseBase64Encode(sig)), nil
+}
+
+// signingAlgorithm returns the JWS "alg" value libtrust will use when
+// signing with key, so it can be embedded in the JOSE header before the
+// header itself becomes part of the signed content.
+func signingAlgorithm(key libtrust.PrivateKey) string {
+	if key.KeyType() != "EC" {
+		return "RS256"
+	}
+
+	if ecKey, ok := key.CryptoPrivateKey().(*ecdsa.PrivateKey); ok {
+		switch ecKey.Curve.Params().BitSize {
+		case 384:
+			return "ES384"
+		case 521:
+			return "ES512"
+		}
+	}
+
+	return "ES256"
+}
+
+// randomJWTID returns a random, base64url-encoded token identifier for the
+// "jti" claim.
+func randomJWTID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return joseBase64Encode(b), nil
+}
+
+// joseBase64Encode encodes data using the unpadded base64url alphabet
+// required by the JOSE (JSON Object Signing and Encryption) specs.
+func joseBase64Encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}